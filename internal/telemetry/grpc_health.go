@@ -0,0 +1,27 @@
+package telemetry
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var grpcConnHealth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "pomerium",
+		Subsystem: "grpc_client",
+		Name:      "connection_healthy",
+		Help:      "Whether the most recent grpc.health.v1 check against a pomerium gRPC client connection succeeded (1) or not (0).",
+	},
+	[]string{"service", "connection"},
+)
+
+func init() {
+	prometheus.MustRegister(grpcConnHealth)
+}
+
+// SetGRPCConnHealth records the outcome of the most recent health check against the named
+// connection for service, exposed as the pomerium_grpc_client_connection_healthy metric.
+func SetGRPCConnHealth(service, connection string, healthy bool) {
+	v := 0.0
+	if healthy {
+		v = 1.0
+	}
+	grpcConnHealth.WithLabelValues(service, connection).Set(v)
+}
@@ -3,11 +3,8 @@ package grpc
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/url"
 	"strconv"
@@ -15,9 +12,16 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/telemetry"
@@ -27,6 +31,10 @@ import (
 const (
 	defaultGRPCSecurePort   = 443
 	defaultGRPCInsecurePort = 80
+
+	// defaultHealthCheckFailureThreshold is the default number of consecutive failed health
+	// checks required before a monitored connection is closed and rebuilt.
+	defaultHealthCheckFailureThreshold = 3
 )
 
 // Options contains options for connecting to a pomerium rpc service.
@@ -41,10 +49,29 @@ type Options struct {
 	CA string
 	// CAFile specifies the TLS certificate authority file to use.
 	CAFile string
+	// ClientCert specifies the base64 encoded TLS client certificate to use for mutual-TLS.
+	ClientCert string
+	// ClientKey specifies the base64 encoded TLS client certificate key to use for mutual-TLS.
+	ClientKey string
+	// ClientCertFile specifies the TLS client certificate file to use for mutual-TLS.
+	ClientCertFile string
+	// ClientKeyFile specifies the TLS client certificate key file to use for mutual-TLS.
+	ClientKeyFile string
+	// PerRPCCredentials specifies credentials, such as an OAuth2 token source or a static
+	// bearer/JWT loader, that are attached to every outgoing RPC. Requires transport security:
+	// NewGRPCClientConn returns an error if WithInsecure is also set.
+	PerRPCCredentials credentials.PerRPCCredentials
 	// RequestTimeout specifies the timeout for individual RPC calls
 	RequestTimeout time.Duration
 	// ClientDNSRoundRobin enables or disables DNS resolver based load balancing
 	ClientDNSRoundRobin bool
+	// ServerAddresses specifies a static list of upstream addresses to dial in place of service
+	// discovery (à la Boulder's static resolver), for environments without service DNS. Takes
+	// precedence over ClientDNSRoundRobin and Addr's scheme.
+	ServerAddresses []string
+	// ServiceConfig specifies a raw gRPC service config (JSON) used to select a client-side load
+	// balancing policy, e.g. round_robin, pick_first, or weighted_target.
+	ServiceConfig string
 
 	// WithInsecure disables transport security for this ClientConn.
 	// Note that transport security is required unless WithInsecure is set.
@@ -52,27 +79,69 @@ type Options struct {
 
 	// ServiceName specifies the service name for telemetry exposition
 	ServiceName string
+
+	// DialBlock, if set, causes NewGRPCClientConn to block until the connection is up, rather
+	// than discovering connectivity problems on first RPC. No dial deadline is applied.
+	DialBlock bool
+	// BackoffBaseDelay, if set, overrides the base delay for the gRPC connection backoff strategy.
+	BackoffBaseDelay time.Duration
+	// BackoffMaxDelay, if set, overrides the max delay for the gRPC connection backoff strategy.
+	BackoffMaxDelay time.Duration
+
+	// HealthCheckInterval, if set, enables periodic grpc.health.v1 health checking of the
+	// connection. After HealthCheckFailureThreshold consecutive failures the connection is
+	// closed and rebuilt.
+	HealthCheckInterval time.Duration
+	// HealthCheckFailureThreshold is the number of consecutive failed health checks required
+	// before a connection is rebuilt. Defaults to defaultHealthCheckFailureThreshold.
+	HealthCheckFailureThreshold int
+
+	// RetryPolicy, if set, retries (and optionally hedges) unary RPCs on transient failures.
+	RetryPolicy *RetryPolicy
 }
 
-// NewGRPCClientConn returns a new gRPC pomerium service client connection.
+// NewGRPCClientConn returns a new gRPC pomerium service client connection. Unlike
+// GetGRPCClientConn, the TLS material backing the connection is loaded once and is not watched
+// for rotation.
 func NewGRPCClientConn(opts *Options) (*grpc.ClientConn, error) {
+	var reloader *tlsReloader
+	if !opts.WithInsecure {
+		var err error
+		reloader, err = newTLSReloader(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newGRPCClientConn(opts, reloader)
+}
+
+// newGRPCClientConn dials a new connection using the given, already-loaded TLS reloader (nil if
+// opts.WithInsecure).
+func newGRPCClientConn(opts *Options, reloader *tlsReloader) (*grpc.ClientConn, error) {
 	if opts.Addr == nil {
 		return nil, errors.New("internal/grpc: connection address required")
 	}
 	connAddr := opts.Addr.Host
 
+	// xds and dns-srv targets carry their own addressing scheme and aren't host:port pairs;
+	// a static list of server addresses bypasses Addr entirely.
+	usesCustomResolver := len(opts.ServerAddresses) > 0 || opts.Addr.Scheme == "dns-srv" || opts.Addr.Scheme == "xds"
+
 	// no colon exists in the connection string, assume one must be added manually
-	if _, _, err := net.SplitHostPort(connAddr); err != nil {
-		if opts.Addr.Scheme == "https" {
-			connAddr = net.JoinHostPort(connAddr, strconv.Itoa(defaultGRPCSecurePort))
-		} else {
-			connAddr = net.JoinHostPort(connAddr, strconv.Itoa(defaultGRPCInsecurePort))
+	if !usesCustomResolver {
+		if _, _, err := net.SplitHostPort(connAddr); err != nil {
+			if opts.Addr.Scheme == "https" {
+				connAddr = net.JoinHostPort(connAddr, strconv.Itoa(defaultGRPCSecurePort))
+			} else {
+				connAddr = net.JoinHostPort(connAddr, strconv.Itoa(defaultGRPCInsecurePort))
+			}
 		}
 	}
 
 	dialOptions := []grpc.DialOption{
 		grpc.WithChainUnaryInterceptor(
 			requestid.UnaryClientInterceptor(),
+			grpcRetryInterceptor(opts.RetryPolicy),
 			grpcTimeoutInterceptor(opts.RequestTimeout),
 		),
 		grpc.WithStreamInterceptor(requestid.StreamClientInterceptor()),
@@ -82,36 +151,38 @@ func NewGRPCClientConn(opts *Options) (*grpc.ClientConn, error) {
 	clientStatsHandler := telemetry.NewGRPCClientStatsHandler(opts.ServiceName)
 	dialOptions = clientStatsHandler.DialOptions(dialOptions...)
 
+	if opts.PerRPCCredentials != nil {
+		if opts.WithInsecure {
+			return nil, errors.New("internal/grpc: WithInsecure cannot be used with PerRPCCredentials")
+		}
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(opts.PerRPCCredentials))
+	}
+
 	if opts.WithInsecure {
 		log.Info().Str("addr", connAddr).Msg("internal/grpc: grpc with insecure")
 		dialOptions = append(dialOptions, grpc.WithInsecure())
 	} else {
-		rootCAs, err := x509.SystemCertPool()
-		if err != nil {
-			log.Warn().Msg("internal/grpc: failed getting system cert pool making new one")
-			rootCAs = x509.NewCertPool()
-		}
-		if opts.CA != "" || opts.CAFile != "" {
-			var ca []byte
-			var err error
-			if opts.CA != "" {
-				ca, err = base64.StdEncoding.DecodeString(opts.CA)
-				if err != nil {
-					return nil, fmt.Errorf("failed to decode certificate authority: %w", err)
-				}
+		// Verification is done manually in reloader.verifyPeerCertificate against the
+		// reloader's current root pool, since tls.Config.RootCAs can't be swapped on a live
+		// config: this lets CA rotations (and client cert rotations, via GetClientCertificate)
+		// take effect without closing this ClientConn. serverName matches what OverrideServerName
+		// below sets gRPC's own ServerName to, so the manual verification still checks the peer's
+		// hostname/SANs instead of accepting any certificate chaining to a trusted root.
+		serverName := opts.OverrideCertificateName
+		if serverName == "" {
+			if host, _, err := net.SplitHostPort(connAddr); err == nil {
+				serverName = host
 			} else {
-				ca, err = ioutil.ReadFile(opts.CAFile)
-				if err != nil {
-					return nil, fmt.Errorf("certificate authority file %v not readable: %w", opts.CAFile, err)
-				}
+				serverName = connAddr
 			}
-			if ok := rootCAs.AppendCertsFromPEM(ca); !ok {
-				return nil, fmt.Errorf("failed to append CA cert to certPool")
-			}
-			log.Debug().Msg("internal/grpc: added custom certificate authority")
+		}
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify:    true, // nolint: gosec
+			VerifyPeerCertificate: reloader.verifyPeerCertificate(serverName),
+			GetClientCertificate:  reloader.GetClientCertificate,
 		}
 
-		cert := credentials.NewTLS(&tls.Config{RootCAs: rootCAs})
+		cert := credentials.NewTLS(tlsConfig)
 
 		// override allowed certificate name string, typically used when doing behind ingress connection
 		if opts.OverrideCertificateName != "" {
@@ -125,16 +196,64 @@ func NewGRPCClientConn(opts *Options) (*grpc.ClientConn, error) {
 		dialOptions = append(dialOptions, grpc.WithTransportCredentials(cert))
 	}
 
-	if opts.ClientDNSRoundRobin {
-		dialOptions = append(dialOptions, grpc.WithBalancerName(roundrobin.Name), grpc.WithDisableServiceConfig())
+	switch {
+	case len(opts.ServerAddresses) > 0:
+		// static, in-process resolver for environments without service discovery, à la
+		// Boulder's static resolver.
+		addrs := make([]resolver.Address, len(opts.ServerAddresses))
+		for i, a := range opts.ServerAddresses {
+			addrs[i] = resolver.Address{Addr: a}
+		}
+		r := manual.NewBuilderWithScheme("pomerium-static")
+		r.InitialState(resolver.State{Addresses: addrs})
+		dialOptions = append(dialOptions, grpc.WithResolvers(r))
+		connAddr = fmt.Sprintf("%s:///%s", r.Scheme(), connAddr)
+	case opts.Addr.Scheme == "dns-srv":
+		connAddr = fmt.Sprintf("dns-srv:///%s", connAddr)
+	case opts.Addr.Scheme == "xds":
+		connAddr = fmt.Sprintf("xds:///%s", connAddr)
+	case opts.ClientDNSRoundRobin:
+		dialOptions = append(dialOptions, grpc.WithBalancerName(roundrobin.Name))
 		connAddr = fmt.Sprintf("dns:///%s", connAddr)
 	}
+
+	switch {
+	case opts.ServiceConfig != "":
+		// a service config (e.g. selecting weighted_target) was supplied explicitly, so let it
+		// take effect rather than disabling it.
+		dialOptions = append(dialOptions, grpc.WithDefaultServiceConfig(opts.ServiceConfig))
+	case opts.ClientDNSRoundRobin:
+		dialOptions = append(dialOptions, grpc.WithDisableServiceConfig())
+	}
+
+	if opts.DialBlock {
+		dialOptions = append(dialOptions, grpc.WithBlock())
+	}
+
+	if opts.BackoffBaseDelay > 0 || opts.BackoffMaxDelay > 0 {
+		bc := backoff.DefaultConfig
+		if opts.BackoffBaseDelay > 0 {
+			bc.BaseDelay = opts.BackoffBaseDelay
+		}
+		if opts.BackoffMaxDelay > 0 {
+			bc.MaxDelay = opts.BackoffMaxDelay
+		}
+		dialOptions = append(dialOptions, grpc.WithConnectParams(grpc.ConnectParams{Backoff: bc}))
+	}
+
 	return grpc.Dial(
 		connAddr,
 		dialOptions...,
 	)
 }
 
+// NewOAuthPerRPCCredentials wraps an oauth2.TokenSource as credentials.PerRPCCredentials,
+// refreshing the underlying token automatically as it expires. The resulting credentials
+// require transport security, matching oauth.TokenSource's default behavior.
+func NewOAuthPerRPCCredentials(ts oauth2.TokenSource) credentials.PerRPCCredentials {
+	return oauth.TokenSource{TokenSource: oauth2.ReuseTokenSource(nil, ts)}
+}
+
 // grpcTimeoutInterceptor enforces per-RPC request timeouts
 func grpcTimeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
@@ -148,8 +267,11 @@ func grpcTimeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
 }
 
 type grpcClientConnRecord struct {
-	conn *grpc.ClientConn
-	opts *Options
+	conn              *grpc.ClientConn
+	opts              *Options
+	tlsFingerprint    string
+	cancelHealthCheck context.CancelFunc
+	cancelTLSWatch    context.CancelFunc
 }
 
 var grpcClientConns = struct {
@@ -159,33 +281,158 @@ var grpcClientConns = struct {
 	m: make(map[string]grpcClientConnRecord),
 }
 
+// optsCmpOptions excludes fields go-cmp can't diff without panicking from the Options equality
+// check in GetGRPCClientConn. PerRPCCredentials implementations (e.g. the oauth.TokenSource
+// NewOAuthPerRPCCredentials returns) hold unexported state such as a sync.Mutex, which go-cmp
+// refuses to traverse on its own; PerRPCCredentials is instead compared by identity below.
+var optsCmpOptions = cmp.Options{cmpopts.IgnoreFields(Options{}, "PerRPCCredentials")}
+
 // GetGRPCClientConn returns a gRPC client connection for the given name. If a connection for that name has already been
-// established the existing connection will be returned. If any options change for that connection, the existing
-// connection will be closed and a new one established.
+// established the existing connection will be returned. If any options change for that connection, or the TLS material
+// on disk (CAFile, ClientCertFile, ClientKeyFile) has rotated, the existing connection will be closed and a new one
+// established.
 func GetGRPCClientConn(name string, opts *Options) (*grpc.ClientConn, error) {
+	// Loading the TLS material (disk reads, key parsing) is done before taking
+	// grpcClientConns' lock: it's only needed to detect rotation, and doing it while holding a
+	// process-wide lock would head-of-line block every other named connection (and
+	// monitorGRPCConnHealth's bookkeeping) behind this one's disk I/O.
+	var reloader *tlsReloader
+	if !opts.WithInsecure {
+		var err error
+		reloader, err = newTLSReloader(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var fingerprint string
+	if reloader != nil {
+		fingerprint = reloader.Fingerprint()
+	}
+
 	grpcClientConns.Lock()
 	defer grpcClientConns.Unlock()
 
 	current, ok := grpcClientConns.m[name]
 	if ok {
-		if cmp.Equal(current.opts, opts) {
+		samePerRPCCredentials := current.opts.PerRPCCredentials == opts.PerRPCCredentials
+		if samePerRPCCredentials && cmp.Equal(current.opts, opts, optsCmpOptions) && current.tlsFingerprint == fingerprint {
 			return current.conn, nil
 		}
 
+		if current.cancelHealthCheck != nil {
+			current.cancelHealthCheck()
+		}
+		if current.cancelTLSWatch != nil {
+			current.cancelTLSWatch()
+		}
 		err := current.conn.Close()
 		if err != nil {
 			log.Error().Err(err).Msg("grpc: failed to close existing connection")
 		}
 	}
 
-	cc, err := NewGRPCClientConn(opts)
+	cc, err := newGRPCClientConn(opts, reloader)
 	if err != nil {
 		return nil, err
 	}
 
-	grpcClientConns.m[name] = grpcClientConnRecord{
-		conn: cc,
-		opts: opts,
+	record := grpcClientConnRecord{
+		conn:           cc,
+		opts:           opts,
+		tlsFingerprint: fingerprint,
 	}
+	if opts.HealthCheckInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		record.cancelHealthCheck = cancel
+		go monitorGRPCConnHealth(ctx, name, opts)
+	}
+	if reloader != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		record.cancelTLSWatch = cancel
+		go reloader.watch(ctx, opts)
+	}
+	grpcClientConns.m[name] = record
 	return cc, nil
 }
+
+// monitorGRPCConnHealth periodically runs the standard gRPC health checking protocol against the
+// named connection. After HealthCheckFailureThreshold consecutive failures, the connection is
+// closed and rebuilt in place. The current health state is recorded for telemetry exposition.
+func monitorGRPCConnHealth(ctx context.Context, name string, opts *Options) {
+	threshold := opts.HealthCheckFailureThreshold
+	if threshold <= 0 {
+		threshold = defaultHealthCheckFailureThreshold
+	}
+
+	ticker := time.NewTicker(opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		grpcClientConns.Lock()
+		record, ok := grpcClientConns.m[name]
+		grpcClientConns.Unlock()
+		if !ok {
+			return
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, opts.HealthCheckInterval)
+		_, err := grpc_health_v1.NewHealthClient(record.conn).Check(checkCtx, &grpc_health_v1.HealthCheckRequest{})
+		cancel()
+
+		telemetry.SetGRPCConnHealth(opts.ServiceName, name, err == nil)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		log.Warn().Err(err).Str("name", name).Int("failures", failures).Msg("internal/grpc: health check failed")
+		if failures < threshold {
+			continue
+		}
+		failures = 0
+
+		grpcClientConns.Lock()
+		current, ok := grpcClientConns.m[name]
+		if ok && current.conn == record.conn {
+			// Rebuild through the same reload/record bookkeeping GetGRPCClientConn uses, rather
+			// than the bare constructor, so this reconnect doesn't silently drop the hot-reload
+			// TLS watcher for the connection (and leak the old one).
+			var reloader *tlsReloader
+			var reloadErr error
+			if !opts.WithInsecure {
+				reloader, reloadErr = newTLSReloader(opts)
+			}
+			if reloadErr != nil {
+				log.Error().Err(reloadErr).Str("name", name).Msg("internal/grpc: failed to reload TLS material for unhealthy connection")
+			} else if newConn, err := newGRPCClientConn(opts, reloader); err != nil {
+				log.Error().Err(err).Str("name", name).Msg("internal/grpc: failed to rebuild unhealthy connection")
+			} else {
+				if current.cancelTLSWatch != nil {
+					current.cancelTLSWatch()
+				}
+				if err := current.conn.Close(); err != nil {
+					log.Error().Err(err).Msg("internal/grpc: failed to close unhealthy connection")
+				}
+				current.conn = newConn
+				current.tlsFingerprint = ""
+				current.cancelTLSWatch = nil
+				if reloader != nil {
+					current.tlsFingerprint = reloader.Fingerprint()
+					watchCtx, cancel := context.WithCancel(context.Background())
+					current.cancelTLSWatch = cancel
+					go reloader.watch(watchCtx, opts)
+				}
+				grpcClientConns.m[name] = current
+			}
+		}
+		grpcClientConns.Unlock()
+	}
+}
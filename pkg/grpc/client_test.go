@@ -0,0 +1,113 @@
+package grpc
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func newTestOpts(token string) *Options {
+	return &Options{
+		Addr:              &url.URL{Scheme: "http", Host: "127.0.0.1:0"},
+		PerRPCCredentials: NewOAuthPerRPCCredentials(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})),
+	}
+}
+
+func TestOptsCmpEqualIgnoresPerRPCCredentials(t *testing.T) {
+	a := newTestOpts("a")
+	b := newTestOpts("a")
+
+	// PerRPCCredentials wraps oauth2.ReuseTokenSource, which holds a sync.Mutex; cmp.Equal must
+	// not panic trying to traverse its unexported fields.
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("cmp.Equal panicked comparing Options with PerRPCCredentials set: %v", r)
+		}
+	}()
+	if !cmp.Equal(a, b, optsCmpOptions) {
+		t.Fatal("expected Options with equivalent fields (ignoring PerRPCCredentials) to compare equal")
+	}
+}
+
+func TestGetGRPCClientConnReusesConnectionForUnchangedOpts(t *testing.T) {
+	opts := newTestOpts("a")
+
+	first, err := GetGRPCClientConn("test-reuse", opts)
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	defer first.Close()
+
+	second, err := GetGRPCClientConn("test-reuse", opts)
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	if first != second {
+		t.Fatal("expected GetGRPCClientConn to reuse the existing connection for unchanged opts")
+	}
+}
+
+func TestGetGRPCClientConnRebuildsOnOptsChange(t *testing.T) {
+	first, err := GetGRPCClientConn("test-rebuild", newTestOpts("a"))
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	defer first.Close()
+
+	second, err := GetGRPCClientConn("test-rebuild", newTestOpts("b"))
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	defer second.Close()
+
+	if first == second {
+		t.Fatal("expected GetGRPCClientConn to rebuild the connection when opts change")
+	}
+}
+
+func TestGetGRPCClientConnRebuildsOnCertRotation(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM, _ := generateTestCA(t, "example.com")
+	if err := ioutil.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	opts := &Options{
+		Addr:   &url.URL{Scheme: "https", Host: "127.0.0.1:0"},
+		CAFile: caFile,
+	}
+
+	first, err := GetGRPCClientConn("test-rotate", opts)
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	defer first.Close()
+
+	// an unchanged CA file on disk should not trigger a rebuild
+	same, err := GetGRPCClientConn("test-rotate", opts)
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	if first != same {
+		t.Fatal("expected GetGRPCClientConn to reuse the connection when the CA file is unchanged")
+	}
+
+	rotatedPEM, _ := generateTestCA(t, "example.com")
+	if err := ioutil.WriteFile(caFile, rotatedPEM, 0o600); err != nil {
+		t.Fatalf("failed to rewrite CA file: %v", err)
+	}
+
+	rebuilt, err := GetGRPCClientConn("test-rotate", opts)
+	if err != nil {
+		t.Fatalf("GetGRPCClientConn: %v", err)
+	}
+	defer rebuilt.Close()
+	if first == rebuilt {
+		t.Fatal("expected GetGRPCClientConn to rebuild the connection when the CA fingerprint changes")
+	}
+}
@@ -0,0 +1,248 @@
+package grpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// tlsReloader holds the TLS root CA pool and, optionally, client certificate backing a gRPC
+// connection's credentials, reloading them from disk as CAFile/ClientCertFile/ClientKeyFile
+// change so long-lived control-plane connections don't need to be torn down on cert rotation.
+type tlsReloader struct {
+	mu          sync.RWMutex
+	roots       *x509.CertPool
+	cert        tls.Certificate
+	fingerprint string
+}
+
+// newTLSReloader loads the initial TLS material described by opts and returns a reloader backed
+// by it. It does not itself watch for changes; call watch to do so.
+func newTLSReloader(opts *Options) (*tlsReloader, error) {
+	r := &tlsReloader{}
+	if err := r.reload(opts); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads the CA and, if configured, client certificate material described by opts.
+func (r *tlsReloader) reload(opts *Options) error {
+	rootCAs, caBytes, err := loadRootCAs(opts)
+	if err != nil {
+		return err
+	}
+
+	var cert tls.Certificate
+	var certBytes, keyBytes []byte
+	if opts.ClientCert != "" || opts.ClientCertFile != "" {
+		cert, certBytes, keyBytes, err = loadClientCertificateMaterial(opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	h := sha256.New()
+	h.Write(caBytes)
+	h.Write(certBytes)
+	h.Write(keyBytes)
+	fingerprint := hex.EncodeToString(h.Sum(nil))
+
+	r.mu.Lock()
+	r.roots = rootCAs
+	r.cert = cert
+	r.fingerprint = fingerprint
+	r.mu.Unlock()
+	return nil
+}
+
+// Fingerprint returns the sha256 fingerprint of the currently loaded PEM material.
+func (r *tlsReloader) Fingerprint() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fingerprint
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate, returning the most recently
+// loaded client certificate.
+func (r *tlsReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cert := r.cert
+	return &cert, nil
+}
+
+// verifyPeerCertificate returns a tls.Config.VerifyPeerCertificate callback that performs the
+// verification tls.Config normally performs against RootCAs and the server name, but against the
+// most recently loaded pool. It's wired up via tls.Config.InsecureSkipVerify + VerifyPeerCertificate
+// because the stdlib does not otherwise support swapping RootCAs on a live client-side tls.Config;
+// serverName must still be passed in explicitly since InsecureSkipVerify disables the stdlib's own
+// hostname check along with everything else.
+func (r *tlsReloader) verifyPeerCertificate(serverName string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("internal/grpc: no peer certificate presented")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("internal/grpc: failed to parse peer certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		r.mu.RLock()
+		roots := r.roots
+		r.mu.RUnlock()
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
+// loadRootCAs builds the trusted root pool for opts, starting from the system pool and
+// appending opts.CA/opts.CAFile if set. It also returns the raw CA PEM bytes appended (empty if
+// neither was set), for fingerprinting.
+func loadRootCAs(opts *Options) (*x509.CertPool, []byte, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		log.Warn().Msg("internal/grpc: failed getting system cert pool making new one")
+		rootCAs = x509.NewCertPool()
+	}
+
+	if opts.CA == "" && opts.CAFile == "" {
+		return rootCAs, nil, nil
+	}
+
+	var ca []byte
+	if opts.CA != "" {
+		ca, err = base64.StdEncoding.DecodeString(opts.CA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode certificate authority: %w", err)
+		}
+	} else {
+		ca, err = ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("certificate authority file %v not readable: %w", opts.CAFile, err)
+		}
+	}
+	if ok := rootCAs.AppendCertsFromPEM(ca); !ok {
+		return nil, nil, fmt.Errorf("failed to append CA cert to certPool")
+	}
+	log.Debug().Msg("internal/grpc: added custom certificate authority")
+	return rootCAs, ca, nil
+}
+
+// loadClientCertificateMaterial loads the client certificate/key pair used for mutual-TLS,
+// either from the base64 encoded ClientCert/ClientKey options or from the
+// ClientCertFile/ClientKeyFile paths. It also returns the raw cert and key PEM bytes, for
+// fingerprinting.
+func loadClientCertificateMaterial(opts *Options) (cert tls.Certificate, certBytes, keyBytes []byte, err error) {
+	if opts.ClientCert != "" {
+		certBytes, err = base64.StdEncoding.DecodeString(opts.ClientCert)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, fmt.Errorf("failed to decode client certificate: %w", err)
+		}
+		keyBytes, err = base64.StdEncoding.DecodeString(opts.ClientKey)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, fmt.Errorf("failed to decode client certificate key: %w", err)
+		}
+	} else {
+		certBytes, err = ioutil.ReadFile(opts.ClientCertFile)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, fmt.Errorf("client certificate file %v not readable: %w", opts.ClientCertFile, err)
+		}
+		keyBytes, err = ioutil.ReadFile(opts.ClientKeyFile)
+		if err != nil {
+			return tls.Certificate{}, nil, nil, fmt.Errorf("client certificate key file %v not readable: %w", opts.ClientKeyFile, err)
+		}
+	}
+
+	cert, err = tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+	log.Debug().Msg("internal/grpc: added client certificate for mutual-TLS")
+	return cert, certBytes, keyBytes, nil
+}
+
+// watch reloads the TLS material whenever CAFile, ClientCertFile, or ClientKeyFile change, until
+// ctx is canceled. Errors are logged rather than returned since this runs in the background.
+func (r *tlsReloader) watch(ctx context.Context, opts *Options) {
+	files := make(map[string]struct{})
+	for _, f := range []string{opts.CAFile, opts.ClientCertFile, opts.ClientKeyFile} {
+		if f != "" {
+			files[f] = struct{}{}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("internal/grpc: failed to start TLS material watcher")
+		return
+	}
+	defer watcher.Close()
+
+	dirs := make(map[string]struct{})
+	for f := range files {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("internal/grpc: failed to watch TLS material directory")
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if _, watched := files[event.Name]; !watched {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := r.reload(opts); err != nil {
+				log.Error().Err(err).Str("file", event.Name).Msg("internal/grpc: failed to reload TLS material")
+				continue
+			}
+			log.Info().Str("fingerprint", r.Fingerprint()).Msg("internal/grpc: reloaded TLS material")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("internal/grpc: TLS material watcher error")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package grpc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateTestCA returns a self-signed CA certificate (PEM-encoded) and the x509.Certificate it
+// decodes to, for use as root material in reload tests.
+func generateTestCA(t *testing.T, commonName string) ([]byte, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		DNSNames:              []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert
+}
+
+func TestTLSReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+
+	caPEM, _ := generateTestCA(t, "first.example.com")
+	if err := ioutil.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	r, err := newTLSReloader(&Options{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("newTLSReloader: %v", err)
+	}
+	first := r.Fingerprint()
+	if first == "" {
+		t.Fatal("expected non-empty fingerprint after initial load")
+	}
+
+	// reloading the same material should produce the same fingerprint
+	if err := r.reload(&Options{CAFile: caFile}); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := r.Fingerprint(); got != first {
+		t.Fatalf("fingerprint changed on reload of unchanged material: %v != %v", got, first)
+	}
+
+	// rotating the CA material on disk should change the fingerprint on the next reload
+	rotatedPEM, _ := generateTestCA(t, "second.example.com")
+	if err := ioutil.WriteFile(caFile, rotatedPEM, 0o600); err != nil {
+		t.Fatalf("failed to rewrite CA file: %v", err)
+	}
+	if err := r.reload(&Options{CAFile: caFile}); err != nil {
+		t.Fatalf("reload after rotation: %v", err)
+	}
+	if got := r.Fingerprint(); got == first {
+		t.Fatal("expected fingerprint to change after CA rotation")
+	}
+}
+
+func TestTLSReloaderVerifyPeerCertificateChecksHostname(t *testing.T) {
+	caPEM, _ := generateTestCA(t, "trusted.example.com")
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	r, err := newTLSReloader(&Options{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("newTLSReloader: %v", err)
+	}
+
+	block, _ := pem.Decode(caPEM)
+	if block == nil {
+		t.Fatal("failed to decode test CA PEM")
+	}
+
+	if err := r.verifyPeerCertificate("trusted.example.com")([][]byte{block.Bytes}, nil); err != nil {
+		t.Fatalf("expected verification to succeed for matching hostname: %v", err)
+	}
+	if err := r.verifyPeerCertificate("attacker.example.com")([][]byte{block.Bytes}, nil); err == nil {
+		t.Fatal("expected verification to fail for mismatched hostname")
+	}
+}
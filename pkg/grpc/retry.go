@@ -0,0 +1,215 @@
+package grpc
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoffBase = 100 * time.Millisecond
+	defaultRetryBackoffCap  = 2 * time.Second
+)
+
+// defaultRetryableCodes are the gRPC status codes retried when RetryPolicy.RetryableCodes is unset.
+var defaultRetryableCodes = []codes.Code{
+	codes.Unavailable,
+	codes.DeadlineExceeded,
+	codes.ResourceExhausted,
+}
+
+// RetryPolicy configures automatic retries (and optional hedging) of unary RPCs made over a
+// gRPC connection, so that authorize/authenticate lookups ride out transient control-plane
+// blips without callers needing their own retry loops.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an RPC will be attempted, including the first
+	// attempt. Defaults to defaultRetryMaxAttempts.
+	MaxAttempts int
+	// BackoffBase is the base delay used to compute exponential backoff between attempts.
+	// Defaults to defaultRetryBackoffBase.
+	BackoffBase time.Duration
+	// BackoffCap caps the computed backoff delay. Defaults to defaultRetryBackoffCap.
+	BackoffCap time.Duration
+	// RetryableCodes is the set of gRPC status codes that are retried. Defaults to
+	// defaultRetryableCodes.
+	RetryableCodes []codes.Code
+	// Methods, if non-empty, restricts retries (and hedging) to the listed full gRPC method
+	// names (e.g. "/envoy.service.auth.v3.Authorization/Check"). An empty list allows retries
+	// for all methods.
+	Methods []string
+	// HedgeAfter, if set, launches a second, parallel attempt for methods listed in
+	// HedgeMethods if the first attempt hasn't completed after this delay. Only safe for
+	// idempotent methods.
+	HedgeAfter time.Duration
+	// HedgeMethods lists the full gRPC method names eligible for hedging. Ignored unless
+	// HedgeAfter is set.
+	HedgeMethods []string
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return defaultRetryMaxAttempts
+}
+
+func (p *RetryPolicy) backoffBase() time.Duration {
+	if p.BackoffBase > 0 {
+		return p.BackoffBase
+	}
+	return defaultRetryBackoffBase
+}
+
+func (p *RetryPolicy) backoffCap() time.Duration {
+	if p.BackoffCap > 0 {
+		return p.BackoffCap
+	}
+	return defaultRetryBackoffCap
+}
+
+func (p *RetryPolicy) retryableCodes() []codes.Code {
+	if len(p.RetryableCodes) > 0 {
+		return p.RetryableCodes
+	}
+	return defaultRetryableCodes
+}
+
+func (p *RetryPolicy) appliesTo(method string) bool {
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) hedges(method string) bool {
+	if p.HedgeAfter <= 0 {
+		return false
+	}
+	for _, m := range p.HedgeMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, c := range p.retryableCodes() {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffWithJitter returns a randomized exponential backoff delay for the given attempt
+// (1-indexed), capped at max.
+func backoffWithJitter(attempt int, base, max time.Duration) time.Duration {
+	delay := base << uint(attempt-1)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// grpcRetryInterceptor retries unary RPCs according to policy, honoring RequestTimeout as each
+// attempt's deadline. It is a no-op, single-attempt passthrough when policy is nil.
+func grpcRetryInterceptor(policy *RetryPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if policy == nil || !policy.appliesTo(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		if policy.hedges(method) {
+			return invokeWithHedge(ctx, method, req, reply, cc, invoker, policy, opts...)
+		}
+
+		var err error
+		for attempt := 1; attempt <= policy.maxAttempts(); attempt++ {
+			err = invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil || !policy.retryable(err) || attempt == policy.maxAttempts() {
+				return err
+			}
+			log.Debug().Err(err).Str("method", method).Int("attempt", attempt).Msg("internal/grpc: retrying RPC")
+			select {
+			case <-time.After(backoffWithJitter(attempt, policy.backoffBase(), policy.backoffCap())):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return err
+	}
+}
+
+// invokeWithHedge issues a single attempt, launching a second, parallel attempt after
+// policy.HedgeAfter if the first hasn't returned yet. Whichever attempt returns first wins,
+// whether it succeeded or failed (an error is returned without waiting for the other attempt),
+// and the losing attempt's context is canceled.
+func invokeWithHedge(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, policy *RetryPolicy, opts ...grpc.CallOption) error {
+	type result struct{ err error }
+
+	// Neither attempt unmarshals directly into the caller's reply: canceling an attempt's context
+	// doesn't stop a response that's already in flight from being unmarshaled, so a goroutine for
+	// the losing attempt could otherwise still be writing into reply concurrently with the other
+	// attempt (or with the caller, once we return). Each attempt gets its own reply message, and
+	// only the winner's is copied into reply, once the winner is known.
+	replyType := reflect.TypeOf(reply).Elem()
+	primaryReply := reflect.New(replyType).Interface()
+
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	defer cancelPrimary()
+	primary := make(chan result, 1)
+	go func() {
+		primary <- result{invoker(primaryCtx, method, req, primaryReply, cc, opts...)}
+	}()
+
+	select {
+	case r := <-primary:
+		if r.err == nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(primaryReply).Elem())
+		}
+		return r.err
+	case <-time.After(policy.HedgeAfter):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	hedgeReply := reflect.New(replyType).Interface()
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+	hedge := make(chan result, 1)
+	go func() {
+		hedge <- result{invoker(hedgeCtx, method, req, hedgeReply, cc, opts...)}
+	}()
+
+	select {
+	case r := <-primary:
+		cancelHedge()
+		if r.err == nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(primaryReply).Elem())
+		}
+		return r.err
+	case r := <-hedge:
+		cancelPrimary()
+		if r.err == nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(hedgeReply).Elem())
+		}
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
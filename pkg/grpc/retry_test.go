@@ -0,0 +1,132 @@
+package grpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testReply is a stand-in proto reply message for interceptor tests.
+type testReply struct {
+	Value string
+}
+
+func fakeInvoker(fn func(ctx context.Context, reply interface{}) error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return fn(ctx, reply)
+	}
+}
+
+func TestGrpcRetryInterceptorRetriesRetryableErrors(t *testing.T) {
+	var attempts int32
+	invoker := fakeInvoker(func(_ context.Context, reply interface{}) error {
+		n := atomic.AddInt32(&attempts, 1)
+		if n < 3 {
+			return status.Error(codes.Unavailable, "try again")
+		}
+		reply.(*testReply).Value = "ok"
+		return nil
+	})
+
+	interceptor := grpcRetryInterceptor(&RetryPolicy{
+		MaxAttempts: 3,
+		BackoffBase: time.Millisecond,
+		BackoffCap:  time.Millisecond,
+	})
+
+	reply := &testReply{}
+	err := interceptor(context.Background(), "/svc/Method", nil, reply, nil, invoker)
+	if err != nil {
+		t.Fatalf("expected eventual success, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	if reply.Value != "ok" {
+		t.Fatalf("expected reply to be populated by final attempt, got %+v", reply)
+	}
+}
+
+func TestGrpcRetryInterceptorDoesNotRetryNonRetryableErrors(t *testing.T) {
+	var attempts int32
+	invoker := fakeInvoker(func(_ context.Context, _ interface{}) error {
+		atomic.AddInt32(&attempts, 1)
+		return status.Error(codes.InvalidArgument, "bad request")
+	})
+
+	interceptor := grpcRetryInterceptor(&RetryPolicy{MaxAttempts: 3})
+	err := interceptor(context.Background(), "/svc/Method", nil, &testReply{}, nil, invoker)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument to pass through unchanged, got: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt for a non-retryable error, got %d", attempts)
+	}
+}
+
+func TestGrpcRetryInterceptorNilPolicyIsPassthrough(t *testing.T) {
+	var attempts int32
+	invoker := fakeInvoker(func(_ context.Context, _ interface{}) error {
+		atomic.AddInt32(&attempts, 1)
+		return status.Error(codes.Unavailable, "try again")
+	})
+
+	interceptor := grpcRetryInterceptor(nil)
+	_ = interceptor(context.Background(), "/svc/Method", nil, &testReply{}, nil, invoker)
+	if attempts != 1 {
+		t.Fatalf("expected a nil policy to make a single attempt, got %d", attempts)
+	}
+}
+
+func TestInvokeWithHedgePrimaryWinsWhenFast(t *testing.T) {
+	invoker := fakeInvoker(func(ctx context.Context, reply interface{}) error {
+		reply.(*testReply).Value = "primary"
+		return nil
+	})
+
+	policy := &RetryPolicy{HedgeAfter: time.Hour}
+	reply := &testReply{}
+	err := invokeWithHedge(context.Background(), "/svc/Method", nil, reply, nil, invoker, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Value != "primary" {
+		t.Fatalf("expected primary's reply, got %+v", reply)
+	}
+}
+
+func TestInvokeWithHedgeHedgeWinsWhenPrimarySlow(t *testing.T) {
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		select {
+		case <-time.After(50 * time.Millisecond):
+			reply.(*testReply).Value = "primary"
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var calls int32
+	wrapped := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		reply.(*testReply).Value = "hedge"
+		return nil
+	}
+
+	policy := &RetryPolicy{HedgeAfter: time.Millisecond}
+	reply := &testReply{}
+	err := invokeWithHedge(context.Background(), "/svc/Method", nil, reply, nil, wrapped, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reply.Value != "hedge" {
+		t.Fatalf("expected hedge's reply to win, got %+v", reply)
+	}
+}